@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// Codec decodes a raw nsq message body into a document suitable for
+// enrichment and indexing.
+type Codec interface {
+	Decode(body []byte) (map[string]interface{}, error)
+}
+
+// NewCodec builds the Codec selected by --input-codec. pattern is only used
+// by the regex codec.
+func NewCodec(name string, pattern string) (Codec, error) {
+	switch name {
+	case "json":
+		return jsonCodec{}, nil
+	case "msgpack":
+		return msgpackCodec{}, nil
+	case "raw":
+		return rawCodec{field: "message"}, nil
+	case "regex":
+		if pattern == "" {
+			return nil, fmt.Errorf("--input-codec-pattern is required when --input-codec=regex")
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --input-codec-pattern: %s", err)
+		}
+		if !hasNamedSubexp(re) {
+			return nil, fmt.Errorf("--input-codec-pattern must contain at least one named capture group")
+		}
+		return regexCodec{re: re}, nil
+	default:
+		return nil, fmt.Errorf("unknown --input-codec %q", name)
+	}
+}
+
+// hasNamedSubexp reports whether re has at least one named capture group;
+// an unnamed one (e.g. "(foo)") is syntactically a capture group but
+// regexCodec.Decode skips it, so it isn't good enough on its own.
+func hasNamedSubexp(re *regexp.Regexp) bool {
+	for _, name := range re.SubexpNames()[1:] {
+		if name != "" {
+			return true
+		}
+	}
+	return false
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Decode(body []byte) (map[string]interface{}, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Decode(body []byte) (map[string]interface{}, error) {
+	var doc map[string]interface{}
+	if err := msgpack.Unmarshal(body, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// rawCodec wraps the untouched message body under a single field, for
+// streams that aren't structured at all.
+type rawCodec struct {
+	field string
+}
+
+func (c rawCodec) Decode(body []byte) (map[string]interface{}, error) {
+	return map[string]interface{}{c.field: string(body)}, nil
+}
+
+// regexCodec extracts named capture groups into document fields, grok-style.
+type regexCodec struct {
+	re *regexp.Regexp
+}
+
+func (c regexCodec) Decode(body []byte) (map[string]interface{}, error) {
+	match := c.re.FindSubmatch(body)
+	if match == nil {
+		return nil, fmt.Errorf("--input-codec-pattern did not match message body")
+	}
+	doc := make(map[string]interface{}, len(match))
+	for i, name := range c.re.SubexpNames() {
+		if i == 0 || name == "" {
+			continue
+		}
+		doc[name] = string(match[i])
+	}
+	return doc, nil
+}
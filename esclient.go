@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/olivere/elastic"
+)
+
+// ElasticClientConfig collects everything needed to dial elasticsearch,
+// including the TLS/auth options required to reach a cluster behind
+// X-Pack/OpenSearch security.
+type ElasticClientConfig struct {
+	Addrs    []string
+	Scheme   string
+	Username string
+	Password string
+
+	CACertPath         string
+	ClientCertPath     string
+	ClientKeyPath      string
+	InsecureSkipVerify bool
+
+	// Sniff and HealthcheckInterval exist so operators can ask for them, but
+	// the pinned v0 client (NewClient(*http.Client, ...string)) always
+	// sniffs and healthchecks on its own hardcoded schedule with no public
+	// knob to change that. Rather than silently ignoring a non-default
+	// value - which is exactly how a cluster behind a proxy/LB ends up with
+	// the client trying to dial unreachable intra-cluster addresses -
+	// newElasticClient refuses to start when either is set to anything but
+	// its default. Honoring --es-sniff=false for real requires bumping the
+	// vendored olivere/elastic to a version with SetSniff/SetHealthcheckInterval.
+	Sniff               bool
+	HealthcheckInterval time.Duration
+
+	HTTPTimeout time.Duration
+}
+
+// defaultESHealthcheckInterval is the --es-healthcheck-interval default; see
+// the HealthcheckInterval field doc for why any other value is rejected.
+const defaultESHealthcheckInterval = 60 * time.Second
+
+// newElasticClient builds an elastic.Client whose *http.Client is configured
+// for TLS and basic-auth, since the pinned olivere/elastic v0 API takes an
+// *http.Client rather than option funcs.
+func newElasticClient(cfg ElasticClientConfig) (*elastic.Client, error) {
+	if !cfg.Sniff {
+		return nil, fmt.Errorf("--es-sniff=false is not supported by the pinned elastic client: it always sniffs via NewClient(*http.Client, ...string) with no way to disable it")
+	}
+	if cfg.HealthcheckInterval != defaultESHealthcheckInterval {
+		return nil, fmt.Errorf("--es-healthcheck-interval is not supported by the pinned elastic client; leave it at its default of %s", defaultESHealthcheckInterval)
+	}
+
+	httpClient, err := newElasticHTTPClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return elastic.NewClient(httpClient, elasticAddrsWithScheme(cfg.Addrs, cfg.Scheme)...)
+}
+
+func newElasticHTTPClient(cfg ElasticClientConfig) (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+
+	if cfg.CACertPath != "" {
+		caCert, err := ioutil.ReadFile(cfg.CACertPath)
+		if err != nil {
+			return nil, fmt.Errorf("reading --es-ca-cert: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in --es-ca-cert %s", cfg.CACertPath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.ClientCertPath != "" || cfg.ClientKeyPath != "" {
+		if cfg.ClientCertPath == "" || cfg.ClientKeyPath == "" {
+			return nil, fmt.Errorf("--es-client-cert and --es-client-key must be given together")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCertPath, cfg.ClientKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("loading --es-client-cert/--es-client-key: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := &http.Transport{
+		Dial:            timeoutDialer(cfg.HTTPTimeout),
+		TLSClientConfig: tlsConfig,
+	}
+
+	var roundTripper http.RoundTripper = transport
+	if cfg.Username != "" || cfg.Password != "" {
+		roundTripper = &basicAuthRoundTripper{username: cfg.Username, password: cfg.Password, next: transport}
+	}
+
+	return &http.Client{Transport: roundTripper}, nil
+}
+
+// basicAuthRoundTripper injects HTTP basic-auth credentials on every request,
+// since the pinned elastic.Client has no option for it.
+type basicAuthRoundTripper struct {
+	username string
+	password string
+	next     http.RoundTripper
+}
+
+func (t *basicAuthRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.SetBasicAuth(t.username, t.password)
+	return t.next.RoundTrip(req)
+}
+
+// elasticAddrsWithScheme prefixes bare host:port addresses with --es-scheme,
+// leaving addresses that already specify a scheme untouched.
+func elasticAddrsWithScheme(addrs []string, scheme string) []string {
+	out := make([]string, len(addrs))
+	for i, addr := range addrs {
+		if strings.Contains(addr, "://") {
+			out[i] = addr
+			continue
+		}
+		out[i] = scheme + "://" + addr
+	}
+	return out
+}
+
+func timeoutDialer(timeout time.Duration) func(network, addr string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		conn, err := net.DialTimeout(network, addr, timeout)
+		if err != nil {
+			return nil, err
+		}
+		conn.SetDeadline(time.Now().Add(timeout))
+		return conn, nil
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/bitly/go-nsq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Prometheus metrics exported alongside the existing timermetrics stderr
+// dump, so nsq_to_elasticsearch can be graphed next to the rest of an
+// operator's NSQ/ES dashboards.
+var (
+	messagesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nsq_to_elasticsearch_messages_total",
+		Help: "Messages handled, by topic/channel and outcome.",
+	}, []string{"topic", "channel", "result"})
+
+	esRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "nsq_to_elasticsearch_es_request_duration_seconds",
+		Help:    "Elasticsearch request latency.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"request_type"})
+
+	esBulkMessages = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "nsq_to_elasticsearch_es_bulk_messages",
+		Help:    "Number of messages per elasticsearch bulk request.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+	})
+
+	esBulkBytes = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "nsq_to_elasticsearch_es_bulk_bytes",
+		Help:    "Buffered size of elasticsearch bulk requests, in bytes.",
+		Buckets: prometheus.ExponentialBuckets(1024, 2, 14),
+	})
+
+	esBulkInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "nsq_to_elasticsearch_es_bulk_in_flight",
+		Help: "Number of bulk requests currently in flight.",
+	})
+
+	esRetriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nsq_to_elasticsearch_es_retries_total",
+		Help: "Messages requeued after a retryable elasticsearch error.",
+	}, []string{"topic"})
+
+	dlqTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nsq_to_elasticsearch_dlq_total",
+		Help: "Messages republished to the dead-letter topic.",
+	}, []string{"topic"})
+)
+
+func init() {
+	prometheus.MustRegister(messagesTotal, esRequestDuration, esBulkMessages, esBulkBytes, esBulkInFlight, esRetriesTotal, dlqTotal, consumerStats)
+}
+
+var (
+	consumerMessagesReceivedDesc = prometheus.NewDesc(
+		"nsq_to_elasticsearch_consumer_messages_received_total",
+		"Messages received by the nsq consumer.",
+		[]string{"topic", "channel"}, nil)
+	consumerMessagesFinishedDesc = prometheus.NewDesc(
+		"nsq_to_elasticsearch_consumer_messages_finished_total",
+		"Messages finished by the nsq consumer.",
+		[]string{"topic", "channel"}, nil)
+	consumerMessagesRequeuedDesc = prometheus.NewDesc(
+		"nsq_to_elasticsearch_consumer_messages_requeued_total",
+		"Messages requeued by the nsq consumer.",
+		[]string{"topic", "channel"}, nil)
+	consumerConnectionsDesc = prometheus.NewDesc(
+		"nsq_to_elasticsearch_consumer_connections",
+		"Current nsqd connections held by the consumer.",
+		[]string{"topic", "channel"}, nil)
+)
+
+// consumerStatsEntry is one consumer tracked by consumerStats, labelled by
+// the topic/channel it was created for.
+type consumerStatsEntry struct {
+	consumer *nsq.Consumer
+	topic    string
+	channel  string
+}
+
+// consumerStatsCollector adapts every registered consumer's Stats() into
+// prometheus metrics, polled on every scrape rather than pushed. It's
+// registered once as a single Collector: topic/channel are variable label
+// *values* emitted per entry at Collect time, not separate Desc instances,
+// since prometheus treats each Collector registration as describing a fixed
+// set of Desc - registering one collector per topic against Desc's that
+// don't vary by topic collides on the second topic's registration.
+type consumerStatsCollector struct {
+	mtx     sync.Mutex
+	entries []consumerStatsEntry
+}
+
+var consumerStats = &consumerStatsCollector{}
+
+func (c *consumerStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- consumerMessagesReceivedDesc
+	ch <- consumerMessagesFinishedDesc
+	ch <- consumerMessagesRequeuedDesc
+	ch <- consumerConnectionsDesc
+}
+
+func (c *consumerStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mtx.Lock()
+	entries := append([]consumerStatsEntry(nil), c.entries...)
+	c.mtx.Unlock()
+
+	for _, e := range entries {
+		stats := e.consumer.Stats()
+		ch <- prometheus.MustNewConstMetric(consumerMessagesReceivedDesc, prometheus.CounterValue, float64(stats.MessagesReceived), e.topic, e.channel)
+		ch <- prometheus.MustNewConstMetric(consumerMessagesFinishedDesc, prometheus.CounterValue, float64(stats.MessagesFinished), e.topic, e.channel)
+		ch <- prometheus.MustNewConstMetric(consumerMessagesRequeuedDesc, prometheus.CounterValue, float64(stats.MessagesRequeued), e.topic, e.channel)
+		ch <- prometheus.MustNewConstMetric(consumerConnectionsDesc, prometheus.GaugeValue, float64(len(stats.Connections)), e.topic, e.channel)
+	}
+}
+
+// registerConsumerStats adds a consumer to the shared consumerStats
+// collector so its stats are exported on every scrape.
+func registerConsumerStats(consumer *nsq.Consumer, topic string, channel string) {
+	consumerStats.mtx.Lock()
+	defer consumerStats.mtx.Unlock()
+	consumerStats.entries = append(consumerStats.entries, consumerStatsEntry{consumer: consumer, topic: topic, channel: channel})
+}
@@ -4,15 +4,17 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
-	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"sync"
 	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/bitly/go-nsq"
@@ -20,6 +22,7 @@ import (
 	"github.com/bitly/nsq/util/timermetrics"
 	"github.com/jehiah/go-strftime"
 	"github.com/olivere/elastic"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
@@ -34,38 +37,50 @@ var (
 	refreshInterval = flag.Duration("refresh-interval", 1*time.Minute, "topic discovery refresh interval")
 	statusEvery     = flag.Int("status-every", 250, "the # of requests between logging status (per handler), 0 disables")
 
-	indexName = flag.String("index-name", "logstash-%Y.%m.%d", "elasticsearch index name (strftime format)")
+	indexName = flag.String("index-name", "logstash-%Y.%m.%d", `elasticsearch index name, strftime format plus optional field templating, e.g. "logs-{{.service}}-%Y.%m.%d"`)
 	indexType = flag.String("index-type", "logstash", "elasticsearch index mapping")
 
+	rolloverAlias         = flag.String("rollover-alias", "", "index into this write alias instead of --index-name, and roll it over via _rollover when a threshold is hit")
+	rolloverMaxSize       = flag.String("rollover-max-size", "", "_rollover max_size condition, e.g. 5gb (disabled if empty)")
+	rolloverMaxAge        = flag.String("rollover-max-age", "", "_rollover max_age condition, e.g. 1d (disabled if empty)")
+	rolloverCheckInterval = flag.Duration("rollover-check-interval", 1*time.Minute, "how often to check --rollover-max-size/--rollover-max-age against --rollover-alias")
+
+	bulkActions       = flag.Int("bulk-actions", 1000, "flush the elasticsearch bulk request after this many messages")
+	bulkSize          = flag.Int("bulk-size", 5*1024*1024, "flush the elasticsearch bulk request after buffering this many bytes")
+	bulkFlushInterval = flag.Duration("bulk-flush-interval", 5*time.Second, "flush the elasticsearch bulk request after this long, regardless of size")
+
+	inputCodec        = flag.String("input-codec", "json", "codec used to decode nsq message bodies: json|msgpack|raw|regex")
+	inputCodecPattern = flag.String("input-codec-pattern", "", "regular expression with named capture groups, used when --input-codec=regex")
+	geoipDBPath       = flag.String("geoip-db", "", "path to a MaxMind GeoIP2 City mmdb, required by the geoip processor")
+
+	dlqTopic = flag.String("dlq-topic", "", "nsq topic to republish un-indexable messages to, instead of requeuing them forever")
+
+	metricsHTTPAddress = flag.String("metrics-http-address", "", "address to expose prometheus metrics on, e.g. :9090 (disabled if empty)")
+
+	esScheme              = flag.String("es-scheme", "http", "scheme to use for --elasticsearch addresses that don't already specify one")
+	esUsername            = flag.String("es-username", "", "username for elasticsearch HTTP basic auth")
+	esPassword            = flag.String("es-password", "", "password for elasticsearch HTTP basic auth")
+	esCACert              = flag.String("es-ca-cert", "", "PEM-encoded CA certificate used to verify the elasticsearch server")
+	esClientCert          = flag.String("es-client-cert", "", "PEM-encoded client certificate for elasticsearch mutual TLS")
+	esClientKey           = flag.String("es-client-key", "", "PEM-encoded client key for elasticsearch mutual TLS")
+	esInsecureSkipVerify  = flag.Bool("es-insecure-skip-verify", false, "skip elasticsearch server certificate verification")
+	esSniff               = flag.Bool("es-sniff", true, "enable elasticsearch cluster sniffing (the pinned elastic client cannot be configured to disable it; startup fails if set to false)")
+	esHealthcheckInterval = flag.Duration("es-healthcheck-interval", defaultESHealthcheckInterval, "interval between elasticsearch node healthchecks (the pinned elastic client cannot be configured to use a different one)")
+
 	consumerOpts     = util.StringArray{}
 	elasticAddrs     = util.StringArray{}
 	nsqdTCPAddrs     = util.StringArray{}
 	lookupdHTTPAddrs = util.StringArray{}
+	processors       = util.StringArray{}
 )
 
 func init() {
 	flag.Var(&consumerOpts, "consumer-opt", "option to passthrough to nsq.Consumer (may be given multiple times, http://godoc.org/github.com/bitly/go-nsq#Config)")
 
 	flag.Var(&elasticAddrs, "elasticsearch", "Elasticsearch HTTP address (may be given multiple times)")
+	flag.Var(&nsqdTCPAddrs, "nsqd-tcp-address", "nsqd TCP address (may be given multiple times)")
 	flag.Var(&lookupdHTTPAddrs, "lookupd-http-address", "lookupd HTTP address (may be given multiple times)")
-}
-
-func timeoutClient() *http.Client {
-	TimeoutDialer := func(timeout time.Duration) func(net, addr string) (c net.Conn, err error) {
-		return func(netw, addr string) (net.Conn, error) {
-			conn, err := net.DialTimeout(netw, addr, timeout)
-			if err != nil {
-				return nil, err
-			}
-			conn.SetDeadline(time.Now().Add(timeout))
-			return conn, nil
-		}
-	}
-	return &http.Client{
-		Transport: &http.Transport{
-			Dial: TimeoutDialer(*httpTimeout),
-		},
-	}
+	flag.Var(&processors, "processor", "enrichment processor directive (may be given multiple times): add_field=field=value, timestamp=field:layout, rename=from:to, drop_if=field==value, geoip=field")
 }
 
 type ElasticFactory struct {
@@ -76,10 +91,25 @@ type ElasticFactory struct {
 	wg             sync.WaitGroup
 	mtx            sync.Mutex
 	consumers      []*nsq.Consumer
+	publishers     []*ElasticPublisher
+	dlqProducer    *nsq.Producer
 }
 
 func NewElasticFactory() (*ElasticFactory, error) {
-	return &ElasticFactory{}, nil
+	f := &ElasticFactory{}
+
+	if *dlqTopic != "" {
+		if len(nsqdTCPAddrs) == 0 {
+			return nil, fmt.Errorf("--dlq-topic requires at least one --nsqd-tcp-address")
+		}
+		producer, err := nsq.NewProducer(nsqdTCPAddrs[0], nsq.NewConfig())
+		if err != nil {
+			return nil, err
+		}
+		f.dlqProducer = producer
+	}
+
+	return f, nil
 }
 
 func (f *ElasticFactory) Signal(sig os.Signal) {
@@ -96,10 +126,36 @@ func (f *ElasticFactory) RegisterTopic(name string) error {
 	f.mtx.Lock()
 	defer f.mtx.Unlock()
 	log.Println("Registering topic ", name)
-	publisher, err := NewElasticPublisher(*indexName, *indexType, *statusEvery, []string(elasticAddrs))
+
+	codec, err := NewCodec(*inputCodec, *inputCodecPattern)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	processorChain, err := NewProcessorChain([]string(processors))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	esConfig := ElasticClientConfig{
+		Addrs:               []string(elasticAddrs),
+		Scheme:              *esScheme,
+		Username:            *esUsername,
+		Password:            *esPassword,
+		CACertPath:          *esCACert,
+		ClientCertPath:      *esClientCert,
+		ClientKeyPath:       *esClientKey,
+		InsecureSkipVerify:  *esInsecureSkipVerify,
+		Sniff:               *esSniff,
+		HealthcheckInterval: *esHealthcheckInterval,
+		HTTPTimeout:         *httpTimeout,
+	}
+
+	publisher, err := NewElasticPublisher(*indexName, *indexType, *statusEvery, esConfig, *bulkActions, *bulkSize, *bulkFlushInterval, codec, processorChain, name, *channel, f.dlqProducer, *dlqTopic, *rolloverAlias, *rolloverMaxSize, *rolloverMaxAge, *rolloverCheckInterval)
 	if err != nil {
 		log.Fatal(err)
 	}
+	f.publishers = append(f.publishers, publisher)
 
 	cfg := nsq.NewConfig()
 	cfg.UserAgent = fmt.Sprintf("nsq_to_elasticsearch/%s go-nsq/%s", util.BINARY_VERSION, nsq.VERSION)
@@ -115,6 +171,7 @@ func (f *ElasticFactory) RegisterTopic(name string) error {
 	}
 
 	consumer.AddConcurrentHandlers(publisher, *numPublishers)
+	registerConsumerStats(consumer, name, *channel)
 
 	err = consumer.ConnectToNSQDs(nsqdTCPAddrs)
 	if err != nil {
@@ -138,42 +195,431 @@ func (f *ElasticFactory) Stop() {
 	for _, consumer := range f.consumers {
 		consumer.Stop()
 	}
+
+	// Force an immediate flush of whatever's currently buffered instead of
+	// waiting for the next --bulk-flush-interval tick, but without closing
+	// each publisher's stopChan yet: buffered messages are only Finish/Requeue'd
+	// from flush(), and a consumer's StopChan only closes once its in-flight count
+	// reaches zero, so an in-flight HandleMessage still mid-decode/processor
+	// chain when we stop the loop could append to the bulk request after its
+	// flushLoop has already exited, leaving it stuck forever. Keeping the
+	// flush loop (and its ticker) alive until f.wg.Wait() returns lets it
+	// self-heal any such straggler.
+	for _, publisher := range f.publishers {
+		publisher.flush()
+	}
+
 	f.wg.Wait()
+
+	for _, publisher := range f.publishers {
+		publisher.Stop()
+	}
+
+	if f.dlqProducer != nil {
+		f.dlqProducer.Stop()
+	}
+
+	closeGeoIPReaders()
 }
 
 type ElasticPublisher struct {
 	client  *elastic.Client
 	idxName string
+	idxTmpl *template.Template
 	idxType string
 	metrics *timermetrics.TimerMetrics
+
+	rolloverAlias         string
+	rolloverMaxSize       string
+	rolloverMaxAge        string
+	rolloverCheckInterval time.Duration
+
+	bulkActions       int
+	bulkSize          int
+	bulkFlushInterval time.Duration
+
+	codec      Codec
+	processors []Processor
+	nsqTopic   string
+	nsqChannel string
+
+	dlqProducer *nsq.Producer
+	dlqTopic    string
+
+	mtx          sync.Mutex
+	bulk         *elastic.BulkService
+	pending      []*nsq.Message
+	pendingBytes int
+
+	stopChan chan struct{}
+	wg       sync.WaitGroup
 }
 
-func NewElasticPublisher(indexName string, indexType string, metricsTimeout int, addrs []string) (*ElasticPublisher, error) {
+func NewElasticPublisher(indexName string, indexType string, metricsTimeout int, esConfig ElasticClientConfig, bulkActions int, bulkSize int, bulkFlushInterval time.Duration, codec Codec, processors []Processor, nsqTopic string, nsqChannel string, dlqProducer *nsq.Producer, dlqTopic string, rolloverAlias string, rolloverMaxSize string, rolloverMaxAge string, rolloverCheckInterval time.Duration) (*ElasticPublisher, error) {
 	var err error
 	p := &ElasticPublisher{
-		idxName: indexName,
-		idxType: indexType,
+		idxName:               indexName,
+		idxType:               indexType,
+		bulkActions:           bulkActions,
+		bulkSize:              bulkSize,
+		bulkFlushInterval:     bulkFlushInterval,
+		codec:                 codec,
+		processors:            processors,
+		nsqTopic:              nsqTopic,
+		nsqChannel:            nsqChannel,
+		dlqProducer:           dlqProducer,
+		dlqTopic:              dlqTopic,
+		rolloverAlias:         rolloverAlias,
+		rolloverMaxSize:       rolloverMaxSize,
+		rolloverMaxAge:        rolloverMaxAge,
+		rolloverCheckInterval: rolloverCheckInterval,
+		stopChan:              make(chan struct{}),
+	}
+	p.idxTmpl, err = template.New("index").Option("missingkey=error").Parse(indexName)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --index-name template: %s", err)
 	}
 	p.metrics = timermetrics.NewTimerMetrics(metricsTimeout, "[metrics]:")
-	p.client, err = elastic.NewClient(timeoutClient(), addrs...)
-	return p, err
+	p.client, err = newElasticClient(esConfig)
+	if err != nil {
+		return nil, err
+	}
+	p.bulk = p.client.Bulk()
+
+	p.wg.Add(1)
+	go p.flushLoop()
+
+	if p.rolloverAlias != "" {
+		p.wg.Add(1)
+		go p.rolloverLoop()
+	}
+
+	return p, nil
 }
 
-func (p *ElasticPublisher) indexName() string {
-	tm := time.Now()
-	return strftime.Format(p.idxName, tm)
+// indexName renders --index-name against the decoded document, then applies
+// strftime against the current time, e.g. "logs-{{.service}}-%Y.%m.%d". In
+// --rollover-alias mode the template is unused: every message is indexed
+// into the write alias and elasticsearch itself resolves the backing index.
+func (p *ElasticPublisher) indexName(doc map[string]interface{}) (string, error) {
+	if p.rolloverAlias != "" {
+		return p.rolloverAlias, nil
+	}
+
+	var buf bytes.Buffer
+	if err := p.idxTmpl.Execute(&buf, doc); err != nil {
+		return "", err
+	}
+	return strftime.Format(buf.String(), time.Now()), nil
 }
 
 func (p *ElasticPublisher) indexType() string {
 	return p.idxType
 }
 
+// injectMetadata stamps the standard Logstash-compatible fields onto doc so
+// the default logstash-%Y.%m.%d index name matches Kibana's expected schema.
+// Fields already present in the decoded document are left untouched.
+func (p *ElasticPublisher) injectMetadata(doc map[string]interface{}) {
+	if _, ok := doc["@timestamp"]; !ok {
+		doc["@timestamp"] = time.Now().UTC().Format(time.RFC3339)
+	}
+	if _, ok := doc["@version"]; !ok {
+		doc["@version"] = "1"
+	}
+	if _, ok := doc["host"]; !ok {
+		if hostname, err := os.Hostname(); err == nil {
+			doc["host"] = hostname
+		}
+	}
+	if _, ok := doc["type"]; !ok {
+		doc["type"] = p.idxType
+	}
+	doc["nsq_topic"] = p.nsqTopic
+	doc["nsq_channel"] = p.nsqChannel
+}
+
+// HandleMessage decodes the message body, runs it through the enrichment
+// pipeline, then buffers it into the current bulk request and flushes once
+// --bulk-actions or --bulk-size is hit. The message is not acked until the
+// bulk request it ends up in has been confirmed by elasticsearch, so auto
+// response is disabled and Finish/Requeue are called explicitly from flush().
 func (p *ElasticPublisher) HandleMessage(m *nsq.Message) error {
+	m.DisableAutoResponse()
+
+	doc, err := p.codec.Decode(m.Body)
+	if err != nil {
+		log.Println("failed to decode message, dropping:", err)
+		messagesTotal.WithLabelValues(p.nsqTopic, p.nsqChannel, "decode_error").Inc()
+		m.Finish()
+		return nil
+	}
+	if doc == nil {
+		// A valid-but-empty body (e.g. the literal JSON "null") decodes to a
+		// nil map; treat it as an empty document rather than panicking below.
+		doc = map[string]interface{}{}
+	}
+
+	p.injectMetadata(doc)
+
+	for _, proc := range p.processors {
+		var keep bool
+		doc, keep = proc.Process(doc)
+		if !keep {
+			messagesTotal.WithLabelValues(p.nsqTopic, p.nsqChannel, "dropped").Inc()
+			m.Finish()
+			return nil
+		}
+	}
+
+	idx, err := p.indexName(doc)
+	if err != nil {
+		// A field referenced by --index-name (e.g. {{.service}}) missing from
+		// this particular document can never produce a valid index name, so
+		// treat it the same as any other un-indexable document instead of
+		// silently dropping it.
+		p.deadLetter(m, fmt.Sprintf("rendering index name: %s", err))
+		return nil
+	}
+
+	req := elastic.NewBulkIndexRequest().Index(idx).Type(p.indexType()).Doc(doc)
+
+	p.mtx.Lock()
+	p.bulk.Add(req)
+	p.pending = append(p.pending, m)
+	p.pendingBytes += len(m.Body)
+	shouldFlush := p.bulk.NumberOfActions() >= p.bulkActions || p.pendingBytes >= p.bulkSize
+	p.mtx.Unlock()
+
+	if shouldFlush {
+		p.flush()
+	}
+
+	return nil
+}
+
+// flush ships the current bulk request to elasticsearch and resolves every
+// buffered message: Finish() once it has actually been indexed, Requeue() if
+// it hit a retryable error, or dead-lettered if elasticsearch rejected it
+// outright.
+func (p *ElasticPublisher) flush() {
+	p.mtx.Lock()
+	if p.bulk.NumberOfActions() == 0 {
+		p.mtx.Unlock()
+		return
+	}
+	bulk := p.bulk
+	msgs := p.pending
+	pendingBytes := p.pendingBytes
+	p.bulk = p.client.Bulk()
+	p.pending = nil
+	p.pendingBytes = 0
+	p.mtx.Unlock()
+
+	esBulkMessages.Observe(float64(len(msgs)))
+	esBulkBytes.Observe(float64(pendingBytes))
+
+	esBulkInFlight.Inc()
 	startTime := time.Now()
-	entry := p.client.Index().Index(p.indexName()).Type(p.indexType()).BodyString(string(m.Body))
-	_, err := entry.Do()
+	resp, err := bulk.Do()
+	esRequestDuration.WithLabelValues("bulk").Observe(time.Since(startTime).Seconds())
+	esBulkInFlight.Dec()
 	p.metrics.Status(startTime)
-	return err
+
+	if err != nil {
+		if eerr, ok := err.(*elastic.Error); ok && isTerminalESStatus(eerr.Status) {
+			log.Println("bulk request rejected by elasticsearch, dead-lettering", len(msgs), "messages:", err)
+			for _, m := range msgs {
+				p.deadLetter(m, err.Error())
+			}
+			return
+		}
+		// Connection errors, timeouts, 401/403 (bad --es-username/--es-password),
+		// 409 (version conflict) and 429 (write-queue backpressure) are all
+		// retryable: the batch itself is fine, the cluster or our credentials
+		// just aren't right yet.
+		log.Println("bulk request failed, requeueing", len(msgs), "messages:", err)
+		esRetriesTotal.WithLabelValues(p.nsqTopic).Add(float64(len(msgs)))
+		for _, m := range msgs {
+			messagesTotal.WithLabelValues(p.nsqTopic, p.nsqChannel, "requeued").Inc()
+			m.Requeue(-1)
+		}
+		return
+	}
+
+	for i, m := range msgs {
+		item := bulkResponseItem(resp, i)
+		switch {
+		case item == nil || item.Status < 300:
+			messagesTotal.WithLabelValues(p.nsqTopic, p.nsqChannel, "indexed").Inc()
+			m.Finish()
+		case isTerminalESStatus(item.Status):
+			p.deadLetter(m, item.Error)
+		default:
+			// 409 (version conflict) and 429 (es_rejected_execution_exception,
+			// the write queue is full) are transient, as is any 5xx - retry
+			// rather than lose the document.
+			esRetriesTotal.WithLabelValues(p.nsqTopic).Inc()
+			messagesTotal.WithLabelValues(p.nsqTopic, p.nsqChannel, "requeued").Inc()
+			m.Requeue(-1)
+		}
+	}
+}
+
+// isTerminalESStatus reports whether an elasticsearch response status means
+// the document itself is unindexable and will never succeed on retry (a
+// structural rejection such as mapper_parsing_exception, illegal_argument_exception,
+// or document_too_large). Everything else - auth failures, version conflicts,
+// backpressure, 5xx - is treated as retryable.
+func isTerminalESStatus(status int) bool {
+	return status == 400 || status == 422
+}
+
+// bulkResponseItem returns the single result for the i'th request in a bulk
+// response, regardless of which operation (index/create/update) produced it.
+func bulkResponseItem(resp *elastic.BulkResponse, i int) *elastic.BulkResponseItem {
+	if resp == nil || i >= len(resp.Items) {
+		return nil
+	}
+	for _, item := range resp.Items[i] {
+		return item
+	}
+	return nil
+}
+
+// dlqEnvelope wraps an un-indexable message body with enough context to
+// triage it later from the dead-letter topic.
+type dlqEnvelope struct {
+	OriginalTopic string `json:"original_topic"`
+	Error         string `json:"error"`
+	Timestamp     string `json:"timestamp"`
+	Attempt       uint16 `json:"attempt"`
+	// Body is the original message body as raw JSON when it is valid JSON,
+	// otherwise as a base64-encoded string.
+	Body interface{} `json:"body"`
+}
+
+// deadLetter republishes a message elasticsearch could never index (a
+// terminal 4xx error, e.g. mapper_parsing_exception) to --dlq-topic and
+// finishes it so NSQ stops redelivering it. Without --dlq-topic configured,
+// the message is finished and dropped so it doesn't poison the channel.
+func (p *ElasticPublisher) deadLetter(m *nsq.Message, reason string) {
+	if p.dlqProducer == nil {
+		log.Println("dropping un-indexable message (no --dlq-topic configured):", reason)
+		messagesTotal.WithLabelValues(p.nsqTopic, p.nsqChannel, "dropped").Inc()
+		m.Finish()
+		return
+	}
+
+	var envBody interface{} = json.RawMessage(m.Body)
+	if !json.Valid(m.Body) {
+		// msgpack/raw/regex bodies aren't JSON; []byte marshals as base64.
+		envBody = m.Body
+	}
+	body, err := json.Marshal(dlqEnvelope{
+		OriginalTopic: p.nsqTopic,
+		Error:         reason,
+		Timestamp:     time.Now().UTC().Format(time.RFC3339),
+		Attempt:       m.Attempts,
+		Body:          envBody,
+	})
+	if err != nil {
+		log.Println("failed to marshal dlq envelope, dropping message:", err)
+		messagesTotal.WithLabelValues(p.nsqTopic, p.nsqChannel, "dropped").Inc()
+		m.Finish()
+		return
+	}
+
+	if err := p.dlqProducer.Publish(p.dlqTopic, body); err != nil {
+		log.Println("failed to publish to dlq topic, requeueing instead:", err)
+		messagesTotal.WithLabelValues(p.nsqTopic, p.nsqChannel, "requeued").Inc()
+		m.Requeue(-1)
+		return
+	}
+
+	dlqTotal.WithLabelValues(p.nsqTopic).Inc()
+	messagesTotal.WithLabelValues(p.nsqTopic, p.nsqChannel, "dead_lettered").Inc()
+	m.Finish()
+}
+
+func (p *ElasticPublisher) flushLoop() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.bulkFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.flush()
+		case <-p.stopChan:
+			p.flush()
+			return
+		}
+	}
+}
+
+// rolloverConditions mirrors the shape of an elasticsearch _rollover request
+// body's "conditions" object.
+type rolloverConditions struct {
+	MaxSize string `json:"max_size,omitempty"`
+	MaxAge  string `json:"max_age,omitempty"`
+}
+
+type rolloverRequest struct {
+	Conditions rolloverConditions `json:"conditions"`
+}
+
+type rolloverResponse struct {
+	RolledOver bool   `json:"rolled_over"`
+	NewIndex   string `json:"new_index"`
+}
+
+// rollover asks elasticsearch to roll --rollover-alias over to a new backing
+// index once --rollover-max-size or --rollover-max-age is hit, mirroring ILM.
+func (p *ElasticPublisher) rollover() {
+	conditions := rolloverConditions{MaxSize: p.rolloverMaxSize, MaxAge: p.rolloverMaxAge}
+	if conditions.MaxSize == "" && conditions.MaxAge == "" {
+		return
+	}
+
+	res, err := p.client.PerformRequest("POST", fmt.Sprintf("/%s/_rollover", p.rolloverAlias), nil, rolloverRequest{Conditions: conditions})
+	if err != nil {
+		log.Println("rollover request for", p.rolloverAlias, "failed:", err)
+		return
+	}
+
+	var result rolloverResponse
+	if err := json.Unmarshal(res.Body, &result); err != nil {
+		log.Println("failed to parse rollover response for", p.rolloverAlias, ":", err)
+		return
+	}
+	if result.RolledOver {
+		log.Println("rolled", p.rolloverAlias, "over to", result.NewIndex)
+	}
+}
+
+func (p *ElasticPublisher) rolloverLoop() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.rolloverCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.rollover()
+		case <-p.stopChan:
+			return
+		}
+	}
+}
+
+// Stop flushes any buffered messages and stops the background flusher and
+// rollover checker.
+func (p *ElasticPublisher) Stop() {
+	close(p.stopChan)
+	p.wg.Wait()
 }
 
 func main() {
@@ -198,10 +644,21 @@ func main() {
 		log.Fatal("missing --elasticsearch addresses")
 	}
 
+	if *metricsHTTPAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		go func() {
+			log.Fatal(http.ListenAndServe(*metricsHTTPAddress, mux))
+		}()
+	}
+
 	termChan := make(chan os.Signal, 1)
 	signal.Notify(termChan, syscall.SIGINT, syscall.SIGTERM)
 
 	elasticFactory, err := NewElasticFactory()
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	discoveryCfg := TopicDiscovererConfig{
 		LookupdAddresses: []string(lookupdHTTPAddrs),
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// Processor mutates a decoded document before it is indexed. The returned
+// bool reports whether the document should still be indexed; processors such
+// as drop_if return false to discard the message entirely.
+type Processor interface {
+	Process(doc map[string]interface{}) (map[string]interface{}, bool)
+}
+
+// processorRegistry maps a --processor directive name to a constructor for
+// its Processor, so new stages can be registered here without touching
+// ElasticPublisher.
+var processorRegistry = map[string]func(arg string) (Processor, error){
+	"add_field": newAddFieldProcessor,
+	"timestamp": newTimestampProcessor,
+	"rename":    newRenameProcessor,
+	"drop_if":   newDropIfProcessor,
+	"geoip":     newGeoIPProcessor,
+}
+
+// NewProcessorChain builds the ordered list of processors from --processor
+// directives of the form "name=args".
+func NewProcessorChain(specs []string) ([]Processor, error) {
+	var chain []Processor
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid --processor %q, expected name=args", spec)
+		}
+		factory, ok := processorRegistry[parts[0]]
+		if !ok {
+			return nil, fmt.Errorf("unknown --processor %q", parts[0])
+		}
+		p, err := factory(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, p)
+	}
+	return chain, nil
+}
+
+// add_field=field=value, e.g. add_field=host=%HOSTNAME
+type addFieldProcessor struct {
+	field string
+	value string
+}
+
+func newAddFieldProcessor(arg string) (Processor, error) {
+	parts := strings.SplitN(arg, "=", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("add_field requires field=value, got %q", arg)
+	}
+	value := parts[1]
+	if strings.Contains(value, "%HOSTNAME") {
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "unknown"
+		}
+		value = strings.Replace(value, "%HOSTNAME", hostname, -1)
+	}
+	return &addFieldProcessor{field: parts[0], value: value}, nil
+}
+
+func (p *addFieldProcessor) Process(doc map[string]interface{}) (map[string]interface{}, bool) {
+	doc[p.field] = p.value
+	return doc, true
+}
+
+// timestamp=field:layout, e.g. timestamp=@timestamp:2006-01-02T15:04:05Z
+// parses the existing string value of field using layout and normalizes it
+// to RFC3339 in place.
+type timestampProcessor struct {
+	field  string
+	layout string
+}
+
+func newTimestampProcessor(arg string) (Processor, error) {
+	parts := strings.SplitN(arg, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("timestamp requires field:layout, got %q", arg)
+	}
+	return &timestampProcessor{field: parts[0], layout: parts[1]}, nil
+}
+
+func (p *timestampProcessor) Process(doc map[string]interface{}) (map[string]interface{}, bool) {
+	raw, ok := doc[p.field]
+	if !ok {
+		return doc, true
+	}
+	s, ok := raw.(string)
+	if !ok {
+		return doc, true
+	}
+	t, err := time.Parse(p.layout, s)
+	if err != nil {
+		return doc, true
+	}
+	doc[p.field] = t.Format(time.RFC3339)
+	return doc, true
+}
+
+// rename=from:to, e.g. rename=msg:message
+type renameProcessor struct {
+	from string
+	to   string
+}
+
+func newRenameProcessor(arg string) (Processor, error) {
+	parts := strings.SplitN(arg, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("rename requires from:to, got %q", arg)
+	}
+	return &renameProcessor{from: parts[0], to: parts[1]}, nil
+}
+
+func (p *renameProcessor) Process(doc map[string]interface{}) (map[string]interface{}, bool) {
+	if v, ok := doc[p.from]; ok {
+		delete(doc, p.from)
+		doc[p.to] = v
+	}
+	return doc, true
+}
+
+// drop_if=field==value, e.g. drop_if=level==debug
+type dropIfProcessor struct {
+	field string
+	value string
+}
+
+func newDropIfProcessor(arg string) (Processor, error) {
+	parts := strings.SplitN(arg, "==", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("drop_if requires field==value, got %q", arg)
+	}
+	return &dropIfProcessor{field: parts[0], value: parts[1]}, nil
+}
+
+func (p *dropIfProcessor) Process(doc map[string]interface{}) (map[string]interface{}, bool) {
+	if fmt.Sprintf("%v", doc[p.field]) == p.value {
+		return doc, false
+	}
+	return doc, true
+}
+
+// geoip=field, e.g. geoip=client_ip. Requires --geoip-db to point at a
+// MaxMind GeoIP2 City database.
+type geoipProcessor struct {
+	field string
+	db    *geoip2.Reader
+}
+
+func newGeoIPProcessor(arg string) (Processor, error) {
+	if *geoipDBPath == "" {
+		return nil, fmt.Errorf("--processor geoip=%s requires --geoip-db", arg)
+	}
+	db, err := openGeoIPReader(*geoipDBPath)
+	if err != nil {
+		return nil, fmt.Errorf("opening --geoip-db: %s", err)
+	}
+	return &geoipProcessor{field: arg, db: db}, nil
+}
+
+var (
+	geoipReadersMtx sync.Mutex
+	geoipReaders    = map[string]*geoip2.Reader{}
+)
+
+// openGeoIPReader returns the shared *geoip2.Reader for path, opening and
+// mmapping it at most once. RegisterTopic runs once per matched topic and
+// again on every --refresh-interval tick that discovers a new one, so every
+// geoip processor - across every topic - shares a single reader rather than
+// each holding its own mmap over the same mmdb file.
+func openGeoIPReader(path string) (*geoip2.Reader, error) {
+	geoipReadersMtx.Lock()
+	defer geoipReadersMtx.Unlock()
+
+	if db, ok := geoipReaders[path]; ok {
+		return db, nil
+	}
+	db, err := geoip2.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	geoipReaders[path] = db
+	return db, nil
+}
+
+// closeGeoIPReaders closes every reader opened by openGeoIPReader, called
+// from ElasticFactory.Stop on shutdown.
+func closeGeoIPReaders() {
+	geoipReadersMtx.Lock()
+	defer geoipReadersMtx.Unlock()
+
+	for path, db := range geoipReaders {
+		db.Close()
+		delete(geoipReaders, path)
+	}
+}
+
+func (p *geoipProcessor) Process(doc map[string]interface{}) (map[string]interface{}, bool) {
+	raw, ok := doc[p.field]
+	if !ok {
+		return doc, true
+	}
+	ipStr, ok := raw.(string)
+	if !ok {
+		return doc, true
+	}
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return doc, true
+	}
+	city, err := p.db.City(ip)
+	if err != nil {
+		return doc, true
+	}
+	doc["geoip"] = map[string]interface{}{
+		"ip":           ipStr,
+		"country_code": city.Country.IsoCode,
+		"city_name":    city.City.Names["en"],
+		"location": map[string]interface{}{
+			"lat": city.Location.Latitude,
+			"lon": city.Location.Longitude,
+		},
+	}
+	return doc, true
+}